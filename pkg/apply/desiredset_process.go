@@ -2,8 +2,12 @@ package apply
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"sort"
+	"strings"
 	"sync"
 
 	"github.com/pkg/errors"
@@ -19,6 +23,7 @@ import (
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
 	types2 "k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/tools/cache"
@@ -31,6 +36,18 @@ var (
 	}
 )
 
+const (
+	// LabelApplySetID is written onto every object managed through an apply-set owner -- an
+	// owner whose ownerReferences can't express the relationship because it crosses a namespace
+	// boundary or points from a namespaced owner to a cluster-scoped dependent. It lets the
+	// owner find and prune its dependents without relying on ownerReferences.
+	LabelApplySetID = "objectset.rio.cattle.io/apply-set-id"
+
+	// AnnotationApplySetGVKs is written onto an apply-set owner and lists the comma-separated
+	// group/version/kind values it has dependents tracked under via LabelApplySetID.
+	AnnotationApplySetGVKs = "objectset.rio.cattle.io/apply-set-gvks"
+)
+
 func (o *desiredSet) getControllerAndClient(debugID string, gvk schema.GroupVersionKind) (cache.SharedIndexInformer, dynamic.NamespaceableResourceInterface, error) {
 	// client needs to be accessed first so that the gvk->gvr mapping gets cached
 	client, err := o.a.clients.client(gvk)
@@ -43,7 +60,18 @@ func (o *desiredSet) getControllerAndClient(debugID string, gvk schema.GroupVers
 		informer = o.a.informers[gvk]
 	}
 	if informer == nil && o.informerFactory != nil {
-		newInformer, err := o.informerFactory.Get(gvk, o.a.clients.gvr(gvk))
+		var (
+			newInformer cache.SharedIndexInformer
+			err         error
+		)
+		if o.metadataOnlyPruning {
+			// Prune-only informers only ever need to drive compareSets, shouldPrune and
+			// filterCrossVersion, all of which work off name/namespace/labels/ownerRefs/UID, so
+			// back them with a metadata-only watch instead of caching full object bodies.
+			newInformer, err = o.informerFactory.GetMetadataOnly(gvk, o.a.clients.gvr(gvk))
+		} else {
+			newInformer, err = o.informerFactory.Get(gvk, o.a.clients.gvr(gvk))
+		}
 		if err != nil {
 			return nil, nil, errors.Wrapf(err, "failed to construct informer for %v for %s", gvk, debugID)
 		}
@@ -140,6 +168,145 @@ func (o *desiredSet) assignOwnerReference(gvk schema.GroupVersionKind, objs obje
 	return nil
 }
 
+// applySetIDFor computes the stable apply-set ID for an owner: a hash of its GVK, namespace and
+// name, truncated so it fits within the 63-character limit on label values. It is used in place
+// of an ownerReference UID so that the same ID can be recomputed without reading the owner back
+// from the API server.
+func applySetIDFor(ownerGVK schema.GroupVersionKind, ownerMeta v1.Object) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%s", ownerGVK.String(), ownerMeta.GetNamespace(), ownerMeta.GetName())))
+	return hex.EncodeToString(h[:16])
+}
+
+// applySetIDForOwner returns the apply-set ID for o.applySetParent.
+func (o *desiredSet) applySetIDForOwner() (string, error) {
+	ownerMeta, err := meta.Accessor(o.applySetParent)
+	if err != nil {
+		return "", err
+	}
+	ownerGVK, err := gvk2.Get(o.applySetParent)
+	if err != nil {
+		return "", err
+	}
+	return applySetIDFor(ownerGVK, ownerMeta), nil
+}
+
+// assignApplySetLabel stamps every object in objs with the apply-set ID of o.applySetParent,
+// replacing ownerReferences as the ownership mechanism. Unlike assignOwnerReference this has no
+// namespace or scope restriction, so it's the mechanism used when the owner needs to track
+// dependents in other namespaces or at cluster scope.
+func (o *desiredSet) assignApplySetLabel(gvk schema.GroupVersionKind, objs objectset.ObjectByKey) error {
+	if o.applySetParent == nil {
+		return fmt.Errorf("no apply-set parent set to assign apply-set label")
+	}
+
+	ownerMeta, err := meta.Accessor(o.applySetParent)
+	if err != nil {
+		return err
+	}
+	ownerGVK, err := gvk2.Get(o.applySetParent)
+	if err != nil {
+		return err
+	}
+
+	id := applySetIDFor(ownerGVK, ownerMeta)
+
+	for k, v := range objs {
+		v = v.DeepCopyObject()
+		m, err := meta.Accessor(v)
+		if err != nil {
+			return err
+		}
+
+		if m.GetLabels()[LabelApplySetID] != id {
+			labelSet := m.GetLabels()
+			if labelSet == nil {
+				labelSet = map[string]string{}
+			}
+			labelSet[LabelApplySetID] = id
+			m.SetLabels(labelSet)
+		}
+
+		objs[k] = v
+	}
+
+	return o.recordApplySetGVK(ownerGVK, gvk, ownerMeta)
+}
+
+// recordApplySetGVK merge-patches the owner so that AnnotationApplySetGVKs includes gvk, letting
+// a future sweep discover every GVK that might hold apply-set dependents for this owner.
+//
+// process() runs once per GVK per Apply() call, and each of those calls reaches here wanting to
+// add its own gvk to the same owner's annotation. o.applySetMu serializes those read-modify-write
+// patches, and -- critically -- ownerMeta.SetAnnotations is called with the merged result once
+// the patch succeeds, so the in-memory owner (meta.Accessor gives a view onto o.applySetParent
+// itself, not a copy) is updated in place. Without that, the next GVK processed in this same
+// Apply() call would read the stale pre-patch annotation and clobber what this call just wrote.
+func (o *desiredSet) recordApplySetGVK(ownerGVK, gvk schema.GroupVersionKind, ownerMeta v1.Object) error {
+	o.applySetMu.Lock()
+	defer o.applySetMu.Unlock()
+
+	tracked := map[string]bool{}
+	if existing := ownerMeta.GetAnnotations()[AnnotationApplySetGVKs]; existing != "" {
+		for _, g := range strings.Split(existing, ",") {
+			tracked[g] = true
+		}
+	}
+
+	// gvk.String() contains a comma, so the entries use a group/version/kind form instead.
+	key := gvk.GroupVersion().String() + "/" + gvk.Kind
+	if tracked[key] {
+		return nil
+	}
+	tracked[key] = true
+
+	gvks := make([]string, 0, len(tracked))
+	for g := range tracked {
+		gvks = append(gvks, g)
+	}
+	sort.Strings(gvks)
+	gvksValue := strings.Join(gvks, ",")
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				AnnotationApplySetGVKs: gvksValue,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	client, err := o.a.clients.client(ownerGVK)
+	if err != nil {
+		return err
+	}
+
+	nsed, err := o.a.clients.IsNamespaced(ownerGVK)
+	if err != nil {
+		return err
+	}
+
+	if nsed {
+		_, err = client.Namespace(ownerMeta.GetNamespace()).Patch(o.ctx, ownerMeta.GetName(), types2.MergePatchType, patch, v1.PatchOptions{})
+	} else {
+		_, err = client.Patch(o.ctx, ownerMeta.GetName(), types2.MergePatchType, patch, v1.PatchOptions{})
+	}
+	if err != nil {
+		return err
+	}
+
+	annotations := ownerMeta.GetAnnotations()
+	merged := make(map[string]string, len(annotations)+1)
+	for k, v := range annotations {
+		merged[k] = v
+	}
+	merged[AnnotationApplySetGVKs] = gvksValue
+	ownerMeta.SetAnnotations(merged)
+
+	return nil
+}
+
 func (o *desiredSet) adjustNamespace(gvk schema.GroupVersionKind, objs objectset.ObjectByKey) error {
 	for k, v := range objs {
 		if k.Namespace != "" {
@@ -192,6 +359,99 @@ func (o *desiredSet) createPatcher(client dynamic.NamespaceableResourceInterface
 	}
 }
 
+// DryRunPatcher mirrors Patcher, except the patch is never persisted: the API server computes
+// and returns the object it would produce, which the diff planner compares against the live
+// object.
+type DryRunPatcher func(namespace, name string, pt types2.PatchType, data []byte) (runtime.Object, error)
+
+func (o *desiredSet) createDryRunPatcher(client dynamic.NamespaceableResourceInterface) DryRunPatcher {
+	return func(namespace, name string, pt types2.PatchType, data []byte) (runtime.Object, error) {
+		opts := v1.PatchOptions{DryRun: []string{v1.DryRunAll}}
+		if namespace != "" {
+			return client.Namespace(namespace).Patch(o.ctx, name, pt, data, opts)
+		}
+		return client.Patch(o.ctx, name, pt, data, opts)
+	}
+}
+
+// applyServerSide sends obj to the API server as a Server-Side Apply patch under o.fieldManager,
+// taking ownership of the fields set on obj without computing a diff against the live object.
+func (o *desiredSet) applyServerSide(namespaced bool, client dynamic.NamespaceableResourceInterface, gvk schema.GroupVersionKind, k objectset.ObjectKey, obj runtime.Object, debugID string) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal %s %s for %s", gvk, k, debugID)
+	}
+
+	opts := v1.PatchOptions{
+		FieldManager: o.fieldManager,
+		Force:        &o.forceServerSideApply,
+	}
+
+	var patchErr error
+	if namespaced {
+		_, patchErr = client.Namespace(k.Namespace).Patch(o.ctx, k.Name, types2.ApplyPatchType, data, opts)
+	} else {
+		_, patchErr = client.Patch(o.ctx, k.Name, types2.ApplyPatchType, data, opts)
+	}
+	if patchErr != nil {
+		return errors.Wrapf(patchErr, "failed to server-side apply %s %s for %s", gvk, k, debugID)
+	}
+
+	logrus.Debugf("DesiredSet - Server-Side Applied %s %s for %s", gvk, k, debugID)
+	return nil
+}
+
+// planServerSideApply performs the same Server-Side Apply patch as applyServerSide, but as a
+// server-side dry run, and routes the result into o.plan instead of letting it mutate the
+// cluster -- the SSA equivalent of the patcher swap createPlan performs for the normal diff path.
+// mu guards the writes to o.plan, since process() calls this from parallel workers.
+func (o *desiredSet) planServerSideApply(namespaced bool, client dynamic.NamespaceableResourceInterface, gvk schema.GroupVersionKind, k objectset.ObjectKey, obj runtime.Object, debugID string, existing objectset.ObjectByKey, mu *sync.Mutex) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal %s %s for %s", gvk, k, debugID)
+	}
+
+	opts := v1.PatchOptions{
+		FieldManager: o.fieldManager,
+		Force:        &o.forceServerSideApply,
+		DryRun:       []string{v1.DryRunAll},
+	}
+
+	var (
+		result   runtime.Object
+		patchErr error
+	)
+	if namespaced {
+		result, patchErr = client.Namespace(k.Namespace).Patch(o.ctx, k.Name, types2.ApplyPatchType, data, opts)
+	} else {
+		result, patchErr = client.Patch(o.ctx, k.Name, types2.ApplyPatchType, data, opts)
+	}
+	if patchErr != nil {
+		return errors.Wrapf(patchErr, "failed to dry-run server-side apply %s %s for %s", gvk, k, debugID)
+	}
+
+	if o.planWithDiff {
+		diff, err := unifiedDiff(gvk, k, existing[k], result)
+		if err != nil {
+			return errors.Wrapf(err, "failed to diff %s %s for %s", gvk, k, debugID)
+		}
+		if diff != "" {
+			mu.Lock()
+			if o.plan.Diffs[gvk] == nil {
+				o.plan.Diffs[gvk] = map[objectset.ObjectKey]string{}
+			}
+			o.plan.Diffs[gvk][k] = diff
+			mu.Unlock()
+		}
+		return nil
+	}
+
+	mu.Lock()
+	o.plan.Update.Add(gvk, k.Namespace, k.Name, string(data))
+	mu.Unlock()
+	return nil
+}
+
 func (o *desiredSet) filterCrossVersion(gvk schema.GroupVersionKind, keys []objectset.ObjectKey) []objectset.ObjectKey {
 	result := make([]objectset.ObjectKey, 0, len(keys))
 	gk := gvk.GroupKind()
@@ -232,6 +492,18 @@ func (o *desiredSet) process(debugID string, set labels.Selector, gvk schema.Gro
 		}
 	}
 
+	var applySetID string
+	if o.applySetParent != nil {
+		if err := o.assignApplySetLabel(gvk, objs); err != nil {
+			o.err(err)
+			return
+		}
+		if applySetID, err = o.applySetIDForOwner(); err != nil {
+			o.err(err)
+			return
+		}
+	}
+
 	if nsed {
 		if err := o.adjustNamespace(gvk, objs); err != nil {
 			o.err(err)
@@ -251,42 +523,143 @@ func (o *desiredSet) process(debugID string, set labels.Selector, gvk schema.Gro
 
 	reconciler := o.reconcilers[gvk]
 
-	existing, err := o.list(nsed, controller, client, set, objs)
+	existing, err := o.list(nsed, controller, client, set, objs, applySetID)
 	if err != nil {
 		o.err(errors.Wrapf(err, "failed to list %s for %s", gvk, debugID))
 		return
 	}
 
-	toCreate, toDelete, toUpdate := compareSets(existing, objs)
+	toCreate, toDelete, toUpdate := compareSets(existing, objs, applySetID)
 
 	// check for resources in the objectset but under a different version of the same group/kind
 	toDelete = o.filterCrossVersion(gvk, toDelete)
 
+	// mu guards state shared across the worker pool below: the existing map and toUpdate slice
+	// mutated by the create-time take-over path and the partial-metadata upgrade, o.plan written
+	// by the planning patchers, and o.err which may not be safe for concurrent callers. Declared here, rather than after the createPlan block,
+	// because the diff-mode patcher below also reads existing[k] and must serialize against
+	// those same concurrent writers.
+	var mu sync.Mutex
+
 	if o.createPlan {
 		o.plan.Create[gvk] = toCreate
 		o.plan.Delete[gvk] = toDelete
 
 		reconciler = nil
-		patcher = func(namespace, name string, pt types2.PatchType, data []byte) (runtime.Object, error) {
-			data, err := sanitizePatch(data, true)
-			if err != nil {
-				return nil, err
+		if o.planWithDiff {
+			// Diff mode replaces the raw-JSON-patch plan with a human-readable unified diff,
+			// computed from a server-side dry-run apply so it reflects what the API server
+			// would actually do (defaulting, admission mutation, etc.), not just our patch.
+			dryRunPatcher := o.createDryRunPatcher(client)
+			patcher = func(namespace, name string, pt types2.PatchType, data []byte) (runtime.Object, error) {
+				data, err := sanitizePatch(data, true)
+				if err != nil {
+					return nil, err
+				}
+				if string(data) == "{}" {
+					return nil, nil
+				}
+
+				k := objectset.ObjectKey{Namespace: namespace, Name: name}
+				result, err := dryRunPatcher(namespace, name, pt, data)
+				if err != nil {
+					return nil, errors.Wrapf(err, "failed to dry-run apply %s %s for %s", gvk, k, debugID)
+				}
+
+				// existing is also written to concurrently by updateF's partial-metadata
+				// upgrade (see below), so the read has to go through the same mutex.
+				mu.Lock()
+				existingObj := existing[k]
+				mu.Unlock()
+
+				diff, err := unifiedDiff(gvk, k, existingObj, result)
+				if err != nil {
+					return nil, errors.Wrapf(err, "failed to diff %s %s for %s", gvk, k, debugID)
+				}
+				if diff != "" {
+					mu.Lock()
+					if o.plan.Diffs[gvk] == nil {
+						o.plan.Diffs[gvk] = map[objectset.ObjectKey]string{}
+					}
+					o.plan.Diffs[gvk][k] = diff
+					mu.Unlock()
+				}
+
+				return nil, nil
 			}
-			if string(data) != "{}" {
-				o.plan.Update.Add(gvk, namespace, name, string(data))
+		} else {
+			patcher = func(namespace, name string, pt types2.PatchType, data []byte) (runtime.Object, error) {
+				data, err := sanitizePatch(data, true)
+				if err != nil {
+					return nil, err
+				}
+				if string(data) != "{}" {
+					mu.Lock()
+					o.plan.Update.Add(gvk, namespace, name, string(data))
+					mu.Unlock()
+				}
+				return nil, nil
 			}
-			return nil, nil
 		}
 
 		toCreate = nil
 		toDelete = nil
 	}
 
+	if o.serverSideApply {
+		// Server-Side Apply owns fields through the field manager instead of computing a
+		// three-way merge, so there's no need to take over objects that already exist --
+		// the API server reconciles shared ownership for us.
+		//
+		// o.createPlan still needs to short-circuit this path exactly like it does the
+		// patcher swap above: when planning, every apply must be a dry run that lands in
+		// o.plan instead of mutating the cluster. toCreate/toDelete are already nil'd above
+		// whenever o.createPlan is set, mirroring the non-SSA path, so in practice only
+		// toUpdate ever reaches planServerSideApply -- applyOrPlan checks o.createPlan
+		// itself anyway so that stays true if that nil'ing ever changes.
+		applyOrPlan := func(k objectset.ObjectKey) error {
+			if o.createPlan {
+				return o.planServerSideApply(nsed, client, gvk, k, objs[k], debugID, existing, &mu)
+			}
+			return o.applyServerSide(nsed, client, gvk, k, objs[k], debugID)
+		}
+
+		runParallel(o.ctx, o.parallelism, toCreate, func(k objectset.ObjectKey) {
+			if err := applyOrPlan(k); err != nil {
+				mu.Lock()
+				o.err(err)
+				mu.Unlock()
+			}
+		})
+
+		runParallel(o.ctx, o.parallelism, toUpdate, func(k objectset.ObjectKey) {
+			if err := applyOrPlan(k); err != nil {
+				mu.Lock()
+				o.err(err)
+				mu.Unlock()
+			}
+		})
+
+		runParallel(o.ctx, o.parallelism, toDelete, func(k objectset.ObjectKey) {
+			if err := o.delete(nsed, k.Namespace, k.Name, client, false, gvk); err != nil {
+				mu.Lock()
+				o.err(errors.Wrapf(err, "failed to delete %s %s for %s", k, gvk, debugID))
+				mu.Unlock()
+				return
+			}
+			logrus.Debugf("DesiredSet - Delete %s %s for %s", gvk, k, debugID)
+		})
+
+		return
+	}
+
 	createF := func(k objectset.ObjectKey) {
 		obj := objs[k]
 		obj, err := prepareObjectForCreate(gvk, obj)
 		if err != nil {
+			mu.Lock()
 			o.err(errors.Wrapf(err, "failed to prepare create %s %s for %s", k, gvk, debugID))
+			mu.Unlock()
 			return
 		}
 
@@ -295,13 +668,17 @@ func (o *desiredSet) process(debugID string, set labels.Selector, gvk schema.Gro
 			// Taking over an object that wasn't previously managed by us
 			existingObj, err := o.get(nsed, k.Namespace, k.Name, client)
 			if err == nil {
+				mu.Lock()
 				toUpdate = append(toUpdate, k)
 				existing[k] = existingObj
+				mu.Unlock()
 				return
 			}
 		}
 		if err != nil {
+			mu.Lock()
 			o.err(errors.Wrapf(err, "failed to create %s %s for %s", k, gvk, debugID))
+			mu.Unlock()
 			return
 		}
 		logrus.Debugf("DesiredSet - Created %s %s for %s", gvk, k, debugID)
@@ -309,42 +686,102 @@ func (o *desiredSet) process(debugID string, set labels.Selector, gvk schema.Gro
 
 	deleteF := func(k objectset.ObjectKey, force bool) {
 		if err := o.delete(nsed, k.Namespace, k.Name, client, force, gvk); err != nil {
+			mu.Lock()
 			o.err(errors.Wrapf(err, "failed to delete %s %s for %s", k, gvk, debugID))
+			mu.Unlock()
 			return
 		}
 		logrus.Debugf("DesiredSet - Delete %s %s for %s", gvk, k, debugID)
 	}
 
 	updateF := func(k objectset.ObjectKey) {
-		err := o.compareObjects(gvk, reconciler, patcher, client, debugID, existing[k], objs[k], len(toCreate) > 0 || len(toDelete) > 0)
+		mu.Lock()
+		existingObj := existing[k]
+		mu.Unlock()
+
+		if isPartialObjectMetadata(existingObj) {
+			// The prune informer only cached metadata for this object, so fetch the full
+			// object before diffing it against the desired state. The diff-mode patcher
+			// below reads existing[k] via closure rather than taking it as a parameter, so
+			// the upgraded object must be written back into the shared map, not just kept
+			// in this local variable, or it'll diff against the bare metadata stub.
+			full, err := o.get(nsed, k.Namespace, k.Name, client)
+			if err != nil {
+				mu.Lock()
+				o.err(errors.Wrapf(err, "failed to fetch %s %s for %s", gvk, k, debugID))
+				mu.Unlock()
+				return
+			}
+			existingObj = full
+			mu.Lock()
+			existing[k] = full
+			mu.Unlock()
+		}
+
+		err := o.compareObjects(gvk, reconciler, patcher, client, debugID, existingObj, objs[k], len(toCreate) > 0 || len(toDelete) > 0)
 		if err == ErrReplace {
 			deleteF(k, true)
+			mu.Lock()
 			o.err(fmt.Errorf("DesiredSet - Replace Wait %s %s for %s", gvk, k, debugID))
+			mu.Unlock()
 		} else if err != nil {
+			mu.Lock()
 			o.err(errors.Wrapf(err, "failed to update %s %s for %s", k, gvk, debugID))
+			mu.Unlock()
 		}
 	}
 
-	for _, k := range toCreate {
-		createF(k)
-	}
+	// toCreate is run to completion before toUpdate starts, and toUpdate before toDelete, so
+	// that an update can rely on objects created earlier in this same process() call.
+	runParallel(o.ctx, o.parallelism, toCreate, createF)
+	runParallel(o.ctx, o.parallelism, toUpdate, updateF)
+	runParallel(o.ctx, o.parallelism, toDelete, func(k objectset.ObjectKey) { deleteF(k, false) })
+}
 
-	for _, k := range toUpdate {
-		updateF(k)
+// runParallel invokes fn for each key, using up to limit concurrent workers, and blocks until
+// every key has been processed. A limit of 1 or less, or a single key, runs fn on the calling
+// goroutine without spawning a worker pool.
+func runParallel(ctx context.Context, limit int, keys []objectset.ObjectKey, fn func(objectset.ObjectKey)) {
+	if limit <= 1 || len(keys) <= 1 {
+		for _, k := range keys {
+			fn(k)
+		}
+		return
 	}
 
-	for _, k := range toDelete {
-		deleteF(k, false)
+	sem := make(chan struct{}, limit)
+	wg, _ := errgroup.WithContext(ctx)
+	for _, k := range keys {
+		k := k
+		sem <- struct{}{}
+		wg.Go(func() error {
+			defer func() { <-sem }()
+			fn(k)
+			return nil
+		})
 	}
+	// fn does not return an error; errgroup is reused here purely for its WaitGroup semantics.
+	_ = wg.Wait()
 }
 
+// list returns the existing objects for gvk. When applySetID is non-empty, the owner is tracking
+// this GVK through apply-set labels rather than ownerReferences (it's cross-namespace or
+// cross-scope), so the selector is narrowed to only objects carrying that apply-set ID.
 func (o *desiredSet) list(namespaced bool, informer cache.SharedIndexInformer, client dynamic.NamespaceableResourceInterface,
-	selector labels.Selector, desiredObjects objectset.ObjectByKey) (map[objectset.ObjectKey]runtime.Object, error) {
+	selector labels.Selector, desiredObjects objectset.ObjectByKey, applySetID string) (map[objectset.ObjectKey]runtime.Object, error) {
 	var (
 		errs []error
 		objs = objectset.ObjectByKey{}
 	)
 
+	if applySetID != "" {
+		req, err := labels.NewRequirement(LabelApplySetID, selection.Equals, []string{applySetID})
+		if err != nil {
+			return nil, err
+		}
+		selector = selector.Add(*req)
+	}
+
 	if informer == nil {
 		// If a lister namespace is set, assume all objects belong to the listerNamespace.  If the
 		// desiredSet has an owner but no lister namespace, list objects from all namespaces to ensure
@@ -358,8 +795,9 @@ func (o *desiredSet) list(namespaced bool, informer cache.SharedIndexInformer, c
 			namespaces = desiredObjects.Namespaces()
 		}
 
-		if o.owner != nil && o.listerNamespace == "" {
-			// owner set and unspecified lister namespace, search all namespaces
+		if (o.owner != nil || applySetID != "") && o.listerNamespace == "" {
+			// owner set (or tracked via apply-set label) and unspecified lister namespace,
+			// search all namespaces
 			err := allNamespaceList(o.ctx, client, selector, func(obj unstructured.Unstructured) {
 				if err := addObjectToMap(objs, &obj); err != nil {
 					errs = append(errs, err)
@@ -388,6 +826,8 @@ func (o *desiredSet) list(namespaced bool, informer cache.SharedIndexInformer, c
 		namespace = o.listerNamespace
 	}
 
+	// When informer is a metadata-only informer its indexer holds *v1.PartialObjectMetadata
+	// values; addObjectToMap stores those as-is since meta.Accessor works against them too.
 	err := cache.ListAllByNamespace(informer.GetIndexer(), namespace, selector, func(obj interface{}) {
 		if err := addObjectToMap(objs, obj); err != nil {
 			errs = append(errs, err)
@@ -400,15 +840,21 @@ func (o *desiredSet) list(namespaced bool, informer cache.SharedIndexInformer, c
 	return objs, merr.NewErrors(errs...)
 }
 
-func shouldPrune(obj runtime.Object) bool {
+// shouldPrune reports whether obj is a valid deletion candidate. When applySetID is non-empty it
+// is treated as authoritative: an object that doesn't carry a matching LabelApplySetID is never
+// pruned, even if it otherwise ended up in the existing set.
+func shouldPrune(obj runtime.Object, applySetID string) bool {
 	meta, err := meta.Accessor(obj)
 	if err != nil {
 		return true
 	}
+	if applySetID != "" && meta.GetLabels()[LabelApplySetID] != applySetID {
+		return false
+	}
 	return meta.GetLabels()[LabelPrune] != "false"
 }
 
-func compareSets(existingSet, newSet objectset.ObjectByKey) (toCreate, toDelete, toUpdate []objectset.ObjectKey) {
+func compareSets(existingSet, newSet objectset.ObjectByKey, applySetID string) (toCreate, toDelete, toUpdate []objectset.ObjectKey) {
 	for k := range newSet {
 		if _, ok := existingSet[k]; ok {
 			toUpdate = append(toUpdate, k)
@@ -419,7 +865,7 @@ func compareSets(existingSet, newSet objectset.ObjectByKey) (toCreate, toDelete,
 
 	for k, obj := range existingSet {
 		if _, ok := newSet[k]; !ok {
-			if shouldPrune(obj) {
+			if shouldPrune(obj, applySetID) {
 				toDelete = append(toDelete, k)
 			}
 		}
@@ -438,6 +884,17 @@ func sortObjectKeys(keys []objectset.ObjectKey) {
 	})
 }
 
+// isPartialObjectMetadata reports whether obj came from a metadata-only informer, meaning it
+// carries name/namespace/labels/ownerRefs/UID but no spec.
+func isPartialObjectMetadata(obj runtime.Object) bool {
+	switch obj.(type) {
+	case *v1.PartialObjectMetadata:
+		return true
+	default:
+		return false
+	}
+}
+
 func addObjectToMap(objs objectset.ObjectByKey, obj interface{}) error {
 	metadata, err := meta.Accessor(obj)
 	if err != nil {
@@ -494,3 +951,127 @@ func multiNamespaceList(ctx context.Context, namespaces []string, baseClient dyn
 
 	return wg.Wait()
 }
+
+// unifiedDiff renders a kubectl-diff-style unified diff between the live object and the object
+// the server returned from a dry-run apply. An empty result means the dry-run produced no
+// observable change.
+func unifiedDiff(gvk schema.GroupVersionKind, k objectset.ObjectKey, live, dryRun runtime.Object) (string, error) {
+	liveNormalized, err := normalizeForDiff(live)
+	if err != nil {
+		return "", err
+	}
+	dryRunNormalized, err := normalizeForDiff(dryRun)
+	if err != nil {
+		return "", err
+	}
+
+	liveJSON, err := json.MarshalIndent(liveNormalized, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	dryRunJSON, err := json.MarshalIndent(dryRunNormalized, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	if string(liveJSON) == string(dryRunJSON) {
+		return "", nil
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "--- %s %s\n", gvk.Kind, k)
+	fmt.Fprintf(&buf, "+++ %s %s (dry run)\n", gvk.Kind, k)
+	for _, line := range diffLines(strings.Split(string(liveJSON), "\n"), strings.Split(string(dryRunJSON), "\n")) {
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+
+	return buf.String(), nil
+}
+
+// normalizeForDiff deep-copies obj and clears the metadata fields the API server rewrites on
+// every apply/patch -- dry run or not -- regardless of whether the desired spec actually
+// changed: managedFields (dropped entirely, timestamps included), resourceVersion, and
+// generation. Diffing these in would
+// show a spurious change on essentially every call, defeating the point of a "what will change"
+// diff.
+func normalizeForDiff(obj runtime.Object) (runtime.Object, error) {
+	if obj == nil {
+		return nil, nil
+	}
+
+	normalized := obj.DeepCopyObject()
+	metadata, err := meta.Accessor(normalized)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata.SetManagedFields(nil)
+	metadata.SetResourceVersion("")
+	metadata.SetGeneration(0)
+
+	return normalized, nil
+}
+
+// diffLines returns a and b merged into unified-diff form: unchanged lines prefixed with a
+// space, removed lines with "-", added lines with "+".
+func diffLines(a, b []string) []string {
+	lcs := longestCommonSubsequence(a, b)
+
+	var out []string
+	i, j, k := 0, 0, 0
+	for i < len(a) || j < len(b) {
+		if k < len(lcs) && i < len(a) && j < len(b) && a[i] == lcs[k] && b[j] == lcs[k] {
+			out = append(out, " "+a[i])
+			i++
+			j++
+			k++
+			continue
+		}
+		if i < len(a) && (k >= len(lcs) || a[i] != lcs[k]) {
+			out = append(out, "-"+a[i])
+			i++
+			continue
+		}
+		out = append(out, "+"+b[j])
+		j++
+	}
+
+	return out
+}
+
+// longestCommonSubsequence returns the longest common subsequence of a and b, used to work out
+// which lines are unchanged between the live and dry-run JSON renderings.
+func longestCommonSubsequence(a, b []string) []string {
+	n, m := len(a), len(b)
+	dp := make([][]int, n+1)
+	for i := range dp {
+		dp[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				dp[i][j] = dp[i+1][j+1] + 1
+			} else if dp[i+1][j] >= dp[i][j+1] {
+				dp[i][j] = dp[i+1][j]
+			} else {
+				dp[i][j] = dp[i][j+1]
+			}
+		}
+	}
+
+	var lcs []string
+	i, j := 0, 0
+	for i < n && j < m {
+		if a[i] == b[j] {
+			lcs = append(lcs, a[i])
+			i++
+			j++
+		} else if dp[i+1][j] >= dp[i][j+1] {
+			i++
+		} else {
+			j++
+		}
+	}
+	return lcs
+}
@@ -0,0 +1,220 @@
+package apply
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rancher/wrangler/v2/pkg/objectset"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func newLabeledObject(namespace, name string, labels map[string]string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetNamespace(namespace)
+	u.SetName(name)
+	u.SetLabels(labels)
+	return u
+}
+
+func TestCompareSetsTreatsApplySetIDAsAuthoritative(t *testing.T) {
+	applySetID := "abc123"
+
+	existing := objectset.ObjectByKey{
+		{Namespace: "ns", Name: "tracked"}:   newLabeledObject("ns", "tracked", map[string]string{LabelApplySetID: applySetID}),
+		{Namespace: "ns", Name: "untracked"}: newLabeledObject("ns", "untracked", nil),
+	}
+	desired := objectset.ObjectByKey{}
+
+	toCreate, toDelete, toUpdate := compareSets(existing, desired, applySetID)
+
+	if len(toCreate) != 0 || len(toUpdate) != 0 {
+		t.Fatalf("expected no creates/updates, got toCreate=%v toUpdate=%v", toCreate, toUpdate)
+	}
+	if len(toDelete) != 1 || toDelete[0].Name != "tracked" {
+		t.Fatalf("expected only the apply-set-labeled object queued for delete, got %v", toDelete)
+	}
+}
+
+func TestCompareSetsWithoutApplySetIDPrunesEverythingMissing(t *testing.T) {
+	existing := objectset.ObjectByKey{
+		{Namespace: "ns", Name: "a"}: newLabeledObject("ns", "a", nil),
+	}
+	desired := objectset.ObjectByKey{}
+
+	_, toDelete, _ := compareSets(existing, desired, "")
+
+	if len(toDelete) != 1 {
+		t.Fatalf("expected the object to be pruned when no apply-set scoping is active, got %v", toDelete)
+	}
+}
+
+func TestShouldPrune(t *testing.T) {
+	cases := []struct {
+		name       string
+		obj        runtime.Object
+		applySetID string
+		want       bool
+	}{
+		{"no labels, no apply-set", newLabeledObject("ns", "a", nil), "", true},
+		{"prune=false wins", newLabeledObject("ns", "a", map[string]string{LabelPrune: "false"}), "", false},
+		{"apply-set mismatch blocks prune", newLabeledObject("ns", "a", map[string]string{LabelApplySetID: "other"}), "abc", false},
+		{"apply-set match allows prune", newLabeledObject("ns", "a", map[string]string{LabelApplySetID: "abc"}), "abc", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := shouldPrune(c.obj, c.applySetID); got != c.want {
+				t.Fatalf("shouldPrune() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestLongestCommonSubsequence(t *testing.T) {
+	a := []string{"1", "2", "3", "4"}
+	b := []string{"1", "3", "5", "4"}
+
+	if got, want := longestCommonSubsequence(a, b), []string{"1", "3", "4"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("longestCommonSubsequence() = %v, want %v", got, want)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	a := []string{"1", "2", "3"}
+	b := []string{"1", "3", "4"}
+
+	if got, want := diffLines(a, b), []string{" 1", "-2", " 3", "+4"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("diffLines() = %v, want %v", got, want)
+	}
+}
+
+func TestUnifiedDiffIgnoresServerRewrittenMetadata(t *testing.T) {
+	gvk := schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+	k := objectset.ObjectKey{Namespace: "ns", Name: "foo"}
+
+	live := newLabeledObject("ns", "foo", map[string]string{"a": "b"})
+	live.SetResourceVersion("100")
+	live.SetGeneration(1)
+	live.SetManagedFields([]v1.ManagedFieldsEntry{{Manager: "kubectl", Time: &v1.Time{}}})
+
+	dryRun := newLabeledObject("ns", "foo", map[string]string{"a": "b"})
+	dryRun.SetResourceVersion("101")
+	dryRun.SetGeneration(2)
+	dryRun.SetManagedFields([]v1.ManagedFieldsEntry{{Manager: "apply"}})
+
+	// managedFields, resourceVersion and generation are rewritten by the API server on every
+	// apply, dry-run or not, regardless of whether the desired spec actually changed -- a diff
+	// that didn't normalize these would never report "no change".
+	diff, err := unifiedDiff(gvk, k, live, dryRun)
+	if err != nil {
+		t.Fatalf("unifiedDiff() error = %v", err)
+	}
+	if diff != "" {
+		t.Fatalf("expected no diff when only server-rewritten metadata differs, got:\n%s", diff)
+	}
+}
+
+func TestUnifiedDiffReportsSpecChanges(t *testing.T) {
+	gvk := schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+	k := objectset.ObjectKey{Namespace: "ns", Name: "foo"}
+
+	live := newLabeledObject("ns", "foo", map[string]string{"a": "b"})
+	dryRun := newLabeledObject("ns", "foo", map[string]string{"a": "c"})
+
+	diff, err := unifiedDiff(gvk, k, live, dryRun)
+	if err != nil {
+		t.Fatalf("unifiedDiff() error = %v", err)
+	}
+	if diff == "" {
+		t.Fatal("expected a diff when a label actually changed")
+	}
+}
+
+func TestRunParallelProcessesEveryKeyExactlyOnce(t *testing.T) {
+	keys := make([]objectset.ObjectKey, 20)
+	for i := range keys {
+		keys[i] = objectset.ObjectKey{Namespace: "ns", Name: fmt.Sprintf("obj-%d", i)}
+	}
+
+	var mu sync.Mutex
+	seen := map[objectset.ObjectKey]int{}
+
+	runParallel(context.Background(), 4, keys, func(k objectset.ObjectKey) {
+		mu.Lock()
+		seen[k]++
+		mu.Unlock()
+	})
+
+	if len(seen) != len(keys) {
+		t.Fatalf("expected every key to be processed exactly once, got %d of %d", len(seen), len(keys))
+	}
+	for k, count := range seen {
+		if count != 1 {
+			t.Fatalf("key %v processed %d times, want 1", k, count)
+		}
+	}
+}
+
+func TestRunParallelRunsInOrderWhenNotParallelized(t *testing.T) {
+	keys := []objectset.ObjectKey{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+
+	var order []string
+	runParallel(context.Background(), 1, keys, func(k objectset.ObjectKey) {
+		order = append(order, k.Name)
+	})
+
+	// limit <= 1 takes the non-concurrent path and must preserve caller order -- callers that
+	// disable parallelism rely on this instead of adding their own synchronization.
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(order, want) {
+		t.Fatalf("order = %v, want %v", order, want)
+	}
+}
+
+func TestRunParallelIsABarrier(t *testing.T) {
+	keys := make([]objectset.ObjectKey, 10)
+	for i := range keys {
+		keys[i] = objectset.ObjectKey{Name: fmt.Sprintf("obj-%d", i)}
+	}
+
+	var completed int32
+	runParallel(context.Background(), 4, keys, func(k objectset.ObjectKey) {
+		atomic.AddInt32(&completed, 1)
+	})
+
+	// process() relies on the toCreate call fully draining before it ever starts the toUpdate
+	// call -- if runParallel returned before every key finished, creates and updates could run
+	// against the same objects concurrently.
+	if got := atomic.LoadInt32(&completed); got != int32(len(keys)) {
+		t.Fatalf("expected all %d keys to complete before runParallel returned, got %d", len(keys), got)
+	}
+}
+
+func TestRunParallelAggregatesErrorsUnderMutex(t *testing.T) {
+	keys := make([]objectset.ObjectKey, 50)
+	for i := range keys {
+		keys[i] = objectset.ObjectKey{Name: fmt.Sprintf("obj-%d", i)}
+	}
+
+	var (
+		mu   sync.Mutex
+		errs []error
+	)
+	runParallel(context.Background(), 8, keys, func(k objectset.ObjectKey) {
+		mu.Lock()
+		errs = append(errs, fmt.Errorf("failed %s", k.Name))
+		mu.Unlock()
+	})
+
+	// Exercises the same mutex-guarded append process()/Sweep() use around o.err/errs -- run
+	// with -race to catch a regression here.
+	if len(errs) != len(keys) {
+		t.Fatalf("expected one aggregated error per key, got %d of %d", len(errs), len(keys))
+	}
+}
@@ -0,0 +1,245 @@
+package apply
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/wrangler/v2/pkg/merr"
+	"github.com/rancher/wrangler/v2/pkg/objectset"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+)
+
+// dependent is a single object tracked by a gcIndex: which GVK/key it lives at, and whether
+// pruning it is allowed (LabelPrune == "false" opts an object out, same as compareSets/shouldPrune).
+type dependent struct {
+	gvk      schema.GroupVersionKind
+	key      objectset.ObjectKey
+	prunable bool
+}
+
+// gcKey identifies an object within a gcIndex. Namespace+name alone isn't unique across kinds --
+// a chart routinely produces a ConfigMap and a Secret both named "foo" under the same owner -- so
+// the GVK has to be part of the key, not just carried along on dependent for display purposes.
+type gcKey struct {
+	gvk schema.GroupVersionKind
+	key objectset.ObjectKey
+}
+
+// gcIndex is a reverse ownerReference UID -> dependents index, modeled on the approach the
+// Kubernetes garbage collector itself uses, so Sweep can find every dependent of a torn-down
+// owner in one pass instead of listing each tracked GVK and diffing against an empty desired set.
+type gcIndex struct {
+	mu         sync.RWMutex
+	dependents map[types.UID]map[gcKey]dependent
+}
+
+func newGCIndex() *gcIndex {
+	return &gcIndex{
+		dependents: map[types.UID]map[gcKey]dependent{},
+	}
+}
+
+// set (re)files obj under every UID in its ownerReferences, replacing any stale entry recorded
+// for the same GVK/key under a different owner.
+func (g *gcIndex) set(gvk schema.GroupVersionKind, obj interface{}) {
+	metadata, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+
+	key := objectset.ObjectKey{Namespace: metadata.GetNamespace(), Name: metadata.GetName()}
+	gk := gcKey{gvk: gvk, key: key}
+	d := dependent{
+		gvk:      gvk,
+		key:      key,
+		prunable: metadata.GetLabels()[LabelPrune] != "false",
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.removeLocked(gk)
+	for _, owner := range metadata.GetOwnerReferences() {
+		if g.dependents[owner.UID] == nil {
+			g.dependents[owner.UID] = map[gcKey]dependent{}
+		}
+		g.dependents[owner.UID][gk] = d
+	}
+}
+
+// remove drops obj from the index entirely.
+func (g *gcIndex) remove(gvk schema.GroupVersionKind, obj interface{}) {
+	metadata, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.removeLocked(gcKey{
+		gvk: gvk,
+		key: objectset.ObjectKey{Namespace: metadata.GetNamespace(), Name: metadata.GetName()},
+	})
+}
+
+// removeLocked drops gk from every owner bucket it might currently be filed under. Callers must
+// hold g.mu.
+func (g *gcIndex) removeLocked(gk gcKey) {
+	for uid, deps := range g.dependents {
+		if _, ok := deps[gk]; ok {
+			delete(deps, gk)
+			if len(deps) == 0 {
+				delete(g.dependents, uid)
+			}
+		}
+	}
+}
+
+// dependentsOf returns a snapshot of every object currently filed under uid.
+func (g *gcIndex) dependentsOf(uid types.UID) []dependent {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	deps := g.dependents[uid]
+	result := make([]dependent, 0, len(deps))
+	for _, d := range deps {
+		result = append(result, d)
+	}
+	return result
+}
+
+// ensureGCIndexHandlers wires gcIndex maintenance onto every currently known prune informer,
+// keyed by GVK so repeated Apply() calls don't register duplicate handlers.
+func (o *desiredSet) ensureGCIndexHandlers() error {
+	if o.a.gcIndex == nil {
+		return fmt.Errorf("no garbage-collection index configured")
+	}
+
+	o.a.gcIndexMu.Lock()
+	defer o.a.gcIndexMu.Unlock()
+
+	if o.a.gcIndexRegistered == nil {
+		o.a.gcIndexRegistered = map[schema.GroupVersionKind]bool{}
+	}
+
+	for gvk, informer := range o.pruneTypes {
+		if o.a.gcIndexRegistered[gvk] || informer == nil {
+			continue
+		}
+
+		gvk := gvk
+		index := o.a.gcIndex
+		registration, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				index.set(gvk, obj)
+			},
+			UpdateFunc: func(_, obj interface{}) {
+				index.set(gvk, obj)
+			},
+			DeleteFunc: func(obj interface{}) {
+				if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+					obj = tombstone.Obj
+				}
+				index.remove(gvk, obj)
+			},
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to register garbage-collection handler for %v", gvk)
+		}
+
+		// AddEventHandler only queues the informer's current store to be replayed through
+		// our handler on the informer's own processing goroutine -- it does not populate the
+		// index before returning, even if the informer itself already synced long ago. Without
+		// waiting on the registration's own HasSynced here, the very first Sweep() for a GVK
+		// can race its own just-registered handler and see an empty or partial index, silently
+		// deleting nothing on exactly the call this feature exists for.
+		if !cache.WaitForCacheSync(o.ctx.Done(), registration.HasSynced) {
+			return fmt.Errorf("timed out waiting for garbage-collection handler to sync for %v before sweeping", gvk)
+		}
+
+		o.a.gcIndexRegistered[gvk] = true
+	}
+
+	return nil
+}
+
+// Sweep deletes every object the reverse UID index has recorded as a dependent of owner, across
+// all tracked GVKs, in a single pass. Dependents labeled LabelPrune=false are left in place. Unlike the normal process() path it doesn't require the
+// caller to still know the desired state of owner's dependents -- this is for tearing owner down
+// entirely, including dependents whose controller was already removed and so will never again be
+// seen via an apply() call.
+func (o *desiredSet) Sweep(owner runtime.Object) error {
+	ownerMeta, err := meta.Accessor(owner)
+	if err != nil {
+		return err
+	}
+	if ownerMeta.GetUID() == "" {
+		return fmt.Errorf("owner has no UID set, cannot sweep dependents")
+	}
+
+	if err := o.ensureGCIndexHandlers(); err != nil {
+		return err
+	}
+
+	deps := o.a.gcIndex.dependentsOf(ownerMeta.GetUID())
+
+	limit := o.parallelism
+	if limit < 1 {
+		limit = 1
+	}
+
+	var (
+		mu   sync.Mutex
+		errs []error
+	)
+
+	sem := make(chan struct{}, limit)
+	wg, _ := errgroup.WithContext(o.ctx)
+	for _, d := range deps {
+		d := d
+		if !d.prunable {
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Go(func() error {
+			defer func() { <-sem }()
+
+			client, err := o.a.clients.client(d.gvk)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+				return nil
+			}
+
+			nsed, err := o.a.clients.IsNamespaced(d.gvk)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+				return nil
+			}
+
+			if err := o.delete(nsed, d.key.Namespace, d.key.Name, client, false, d.gvk); err != nil {
+				mu.Lock()
+				errs = append(errs, errors.Wrapf(err, "failed to sweep %s %s", d.gvk, d.key))
+				mu.Unlock()
+				return nil
+			}
+
+			logrus.Debugf("DesiredSet - Swept %s %s owned by %s", d.gvk, d.key, ownerMeta.GetUID())
+			return nil
+		})
+	}
+	_ = wg.Wait()
+
+	return merr.NewErrors(errs...)
+}
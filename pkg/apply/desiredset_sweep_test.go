@@ -0,0 +1,163 @@
+package apply
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newOwnedObject(namespace, name string, gvk schema.GroupVersionKind, ownerUID types.UID, labels map[string]string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetAPIVersion(gvk.GroupVersion().String())
+	u.SetKind(gvk.Kind)
+	u.SetNamespace(namespace)
+	u.SetName(name)
+	u.SetLabels(labels)
+	u.SetOwnerReferences([]v1.OwnerReference{{UID: ownerUID}})
+	return u
+}
+
+func TestGCIndexDistinguishesKindsSharingNamespaceAndName(t *testing.T) {
+	index := newGCIndex()
+
+	configMapGVK := schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+	secretGVK := schema.GroupVersionKind{Version: "v1", Kind: "Secret"}
+	ownerUID := types.UID("owner-1")
+
+	// A chart producing a ConfigMap and a Secret both named "foo" under the same owner is an
+	// entirely ordinary layout -- the index must not collapse them into one entry.
+	index.set(configMapGVK, newOwnedObject("ns", "foo", configMapGVK, ownerUID, nil))
+	index.set(secretGVK, newOwnedObject("ns", "foo", secretGVK, ownerUID, nil))
+
+	deps := index.dependentsOf(ownerUID)
+	if len(deps) != 2 {
+		t.Fatalf("expected 2 dependents sharing namespace/name but differing in kind, got %d: %v", len(deps), deps)
+	}
+
+	seen := map[schema.GroupVersionKind]bool{}
+	for _, d := range deps {
+		seen[d.gvk] = true
+	}
+	if !seen[configMapGVK] || !seen[secretGVK] {
+		t.Fatalf("expected both ConfigMap and Secret dependents, got %v", deps)
+	}
+}
+
+func TestGCIndexRemove(t *testing.T) {
+	index := newGCIndex()
+	gvk := schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+	ownerUID := types.UID("owner-1")
+
+	obj := newOwnedObject("ns", "foo", gvk, ownerUID, nil)
+	index.set(gvk, obj)
+	if len(index.dependentsOf(ownerUID)) != 1 {
+		t.Fatalf("expected 1 dependent after set")
+	}
+
+	index.remove(gvk, obj)
+	if len(index.dependentsOf(ownerUID)) != 0 {
+		t.Fatalf("expected 0 dependents after remove")
+	}
+}
+
+func TestGCIndexPrunable(t *testing.T) {
+	index := newGCIndex()
+	gvk := schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+	ownerUID := types.UID("owner-1")
+
+	index.set(gvk, newOwnedObject("ns", "foo", gvk, ownerUID, map[string]string{LabelPrune: "false"}))
+
+	deps := index.dependentsOf(ownerUID)
+	if len(deps) != 1 || deps[0].prunable {
+		t.Fatalf("expected the LabelPrune=false object to be recorded as non-prunable, got %v", deps)
+	}
+}
+
+func TestGCIndexConcurrentMutation(t *testing.T) {
+	index := newGCIndex()
+	gvk := schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+	ownerUID := types.UID("owner-1")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			obj := newOwnedObject("ns", fmt.Sprintf("obj-%d", i), gvk, ownerUID, nil)
+			index.set(gvk, obj)
+			index.dependentsOf(ownerUID)
+			index.remove(gvk, obj)
+		}()
+	}
+	wg.Wait()
+
+	if deps := index.dependentsOf(ownerUID); len(deps) != 0 {
+		t.Fatalf("expected index to be empty once all concurrent set/remove pairs finished, got %v", deps)
+	}
+}
+
+// TestGCIndexHandlerMustSyncBeforeFirstSweep mirrors the registration ensureGCIndexHandlers
+// performs against a real informer: AddEventHandler only queues a replay of the informer's
+// current store onto the handler, asynchronously, so a caller that trusts the index as soon
+// as AddEventHandler returns -- without waiting on the registration's own HasSynced -- races
+// its own handler and can see an empty index on the very first Sweep() for a GVK.
+func TestGCIndexHandlerMustSyncBeforeFirstSweep(t *testing.T) {
+	gvk := schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+	ownerUID := types.UID("owner-1")
+
+	existing := newOwnedObject("ns", "foo", gvk, ownerUID, nil)
+
+	lw := &cache.ListWatch{
+		ListFunc: func(options v1.ListOptions) (runtime.Object, error) {
+			return &unstructured.UnstructuredList{Items: []unstructured.Unstructured{*existing}}, nil
+		},
+		WatchFunc: func(options v1.ListOptions) (watch.Interface, error) {
+			return watch.NewFake(), nil
+		},
+	}
+	informer := cache.NewSharedIndexInformer(lw, &unstructured.Unstructured{}, 0, cache.Indexers{})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go informer.Run(stop)
+
+	index := newGCIndex()
+	registration, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			index.set(gvk, obj)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			index.set(gvk, obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			index.remove(gvk, obj)
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to register handler: %v", err)
+	}
+
+	// This is the guarantee ensureGCIndexHandlers relies on: once the registration itself
+	// reports synced, the pre-existing object is guaranteed to have been replayed into the
+	// index, so a Sweep() gated on this call is safe from the race the fix addresses.
+	if !cache.WaitForCacheSync(stop, registration.HasSynced) {
+		t.Fatal("handler registration never synced")
+	}
+
+	deps := index.dependentsOf(ownerUID)
+	if len(deps) != 1 {
+		t.Fatalf("expected the pre-existing object to be indexed once the handler synced, got %d: %v", len(deps), deps)
+	}
+}